@@ -5,22 +5,66 @@
 package dns
 
 import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
+// Kind describes what an Envelope produced by an incremental transfer
+// represents.
+type Kind int
+
+const (
+	// EnvelopeValue marks an Envelope as a plain set of RRs, as produced by
+	// AXFR; it is also the Kind of every Envelope that carries an Error. An
+	// up-to-date IXFR reply produces no Envelope at all. This is the zero value.
+	EnvelopeValue Kind = iota
+	// EnvelopeAdd marks an Envelope as a set of RRs to be added to the zone.
+	EnvelopeAdd
+	// EnvelopeRemove marks an Envelope as a set of RRs to be removed from the zone.
+	EnvelopeRemove
+	// EnvelopeAxfrFallback marks an Envelope (and every Envelope that
+	// follows it on the same channel) as having come from a full zone
+	// transfer that the server sent in place of the requested IXFR.
+	EnvelopeAxfrFallback
+)
+
 // Envelope is used when doing a transfer with a remote server.
+//
+// On the In side (InIxfr), Kind tells the caller what RR represents, and in
+// EnvelopeRemove/EnvelopeAdd Envelopes the delimiter SOAs have already been
+// stripped out of RR (EnvelopeAxfrFallback Envelopes carry the reply's RRs
+// unchanged, SOAs included). On the Out side
+// (OutIxfr), it's the other way around: out doesn't look at Kind at all, so
+// an Envelope captured from InIxfr can't be replayed through OutIxfr as-is.
+// See OutIxfr.
 type Envelope struct {
-	RR    []RR  // The set of RRs in the answer section of the AXFR reply message.
+	RR    []RR  // The set of RRs in the answer section of the AXFR/IXFR reply message.
+	Kind  Kind  // What RR represents, see the Envelope* constants. Always EnvelopeValue for AXFR.
 	Error error // If something went wrong, this contains the error.
 }
 
 type Transfer struct {
 	Conn
-	DialTimeout  time.Duration     // net.DialTimeout (ns), defaults to 2 * 1e9
-	ReadTimeout  time.Duration     // net.Conn.SetReadTimeout value for connections (ns), defaults to 2 * 1e9
-	WriteTimeout time.Duration     // net.Conn.SetWriteTimeout value for connections (ns), defaults to 2 * 1e9
-	tsigTimersOnly   bool
+	DialTimeout  time.Duration // net.DialTimeout (ns), defaults to 2 * 1e9
+	ReadTimeout  time.Duration // net.Conn.SetReadDeadline value for reads (ns), defaults to 2 * 1e9
+	WriteTimeout time.Duration // net.Conn.SetWriteDeadline value for writes (ns), defaults to 2 * 1e9
+	Net          string        // Transport to use, "tcp" or "tcp-tls" (RFC 9103 XoT); defaults to "tcp"
+	TLSConfig    *tls.Config   // TLS configuration used when Net is "tcp-tls"
+
+	tsigTimersOnly bool
+	msg            *Msg // Scratch message reused by ReadMsg; only the returned RRs outlive a call.
+
+	// State for the NextRR iterator, used instead of InAxfr/InIxfr when In
+	// is called with a nil envelope channel.
+	rrID    uint16
+	rrFirst bool
+	rrDone  bool
+	rrBuf   []RR
+	rrPos   int
 }
 
 // In performs a [AI]XFR request (depends on the message's Qtype). It returns
@@ -39,24 +83,106 @@ type Transfer struct {
 //	}
 
 func (t *Transfer) In(q *Msg, a string, env chan *Envelope) (err error) {
-	co := new(Conn)
+	switch q.Question[0].Qtype {
+	case TypeAXFR, TypeIXFR:
+	default:
+		return &Error{err: "unsupported question type for transfer"}
+	}
 	timeout := dnsTimeout
 	if t.DialTimeout != 0 {
 		timeout = t.DialTimeout
 	}
-	co.Conn, err = net.DialTimeout("tcp", a, timeout)
+	switch t.Net {
+	case "", "tcp", "tcp4", "tcp6":
+		network := t.Net
+		if network == "" {
+			network = "tcp"
+		}
+		t.Conn.Conn, err = net.DialTimeout(network, a, timeout)
+	case "tcp-tls":
+		t.Conn.Conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", a, t.TLSConfig)
+	default:
+		return &Error{err: "unknown network " + t.Net}
+	}
 	if err != nil {
 		return err
 	}
-	if q.Question[0].Qtype == TypeAXFR {
-		go t.InAxfr(q.Id, env)
+	// q (and in particular its Ns section, which for an IXFR carries the
+	// client's current SOA as required by RFC 1995) is written as-is.
+	if err := t.WriteMsg(q); err != nil {
+		t.Close()
+		return err
+	}
+	if env == nil {
+		// No envelope channel: the caller drives the transfer with NextRR
+		// instead, which is cheaper for huge zones. NextRR only understands
+		// AXFR's SOA-first/SOA-last framing; IXFR's SOA-delimited deltas
+		// need InIxfr's state machine, so it isn't supported here.
+		if q.Question[0].Qtype != TypeAXFR {
+			t.Close()
+			return &Error{err: "NextRR only supports AXFR"}
+		}
+		t.rrID = q.Id
+		t.rrFirst = true
 		return nil
 	}
-	if q.Question[0].Qtype == TypeIXFR {
+	switch q.Question[0].Qtype {
+	case TypeAXFR:
 		go t.InAxfr(q.Id, env)
-		return nil
+	case TypeIXFR:
+		go t.InIxfr(q.Id, env)
+	}
+	return nil
+}
+
+// NextRR returns the next RR of an AXFR started by In with a nil envelope
+// channel, reading further messages from the connection as needed.
+// SOA-first/SOA-last bookkeeping and TSIG verification happen the same way
+// they do for InAxfr, but individual RRs are handed back as soon as they're
+// available instead of being collected into Envelopes, so processing a huge
+// zone doesn't require holding it in memory. NextRR returns io.EOF once the
+// final RR of the transfer has been consumed.
+func (t *Transfer) NextRR() (RR, error) {
+	for t.rrPos >= len(t.rrBuf) {
+		if t.rrDone {
+			return nil, io.EOF
+		}
+		in, err := t.ReadMsg()
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		if in.Id != t.rrID {
+			t.Close()
+			return nil, ErrId
+		}
+		if t.rrFirst {
+			t.rrFirst = false
+			if !isSOAFirst(in) {
+				t.Close()
+				return nil, ErrSoa
+			}
+			t.tsigTimersOnly = true
+			// A lone leading SOA isn't the end of the transfer, it just
+			// means the rest of the zone follows in later messages.
+			if len(in.Answer) > 1 && isSOALast(in) {
+				t.rrDone = true
+			}
+		} else {
+			t.tsigTimersOnly = true
+			if isSOALast(in) {
+				t.rrDone = true
+			}
+		}
+		t.rrBuf = in.Answer
+		t.rrPos = 0
+	}
+	rr := t.rrBuf[t.rrPos]
+	t.rrPos++
+	if t.rrDone && t.rrPos >= len(t.rrBuf) {
+		t.Close()
 	}
-	return nil // TODO(miek): some error
+	return rr, nil
 }
 
 func (t *Transfer) InAxfr(id uint16, c chan *Envelope) {
@@ -66,23 +192,23 @@ func (t *Transfer) InAxfr(id uint16, c chan *Envelope) {
 	for {
 		in, err := t.ReadMsg()
 		if err != nil {
-			c <- &Envelope{nil, err}
+			c <- &Envelope{Error: err}
 			return
 		}
 		if id != in.Id {
-			c <- &Envelope{in.Answer, ErrId}
+			c <- &Envelope{RR: in.Answer, Error: ErrId}
 			return
 		}
 		if first {
 			if !isSOAFirst(in) {
-				c <- &Envelope{in.Answer, ErrSoa}
+				c <- &Envelope{RR: in.Answer, Error: ErrSoa}
 				return
 			}
 			first = !first
 			// only one answer that is SOA, receive more
 			if len(in.Answer) == 1 {
 				t.tsigTimersOnly = true
-				c <- &Envelope{in.Answer, nil}
+				c <- &Envelope{RR: in.Answer}
 				continue
 			}
 		}
@@ -90,59 +216,258 @@ func (t *Transfer) InAxfr(id uint16, c chan *Envelope) {
 		if !first {
 			t.tsigTimersOnly = true // Subsequent envelopes use this.
 			if isSOALast(in) {
-				c <- &Envelope{in.Answer, nil}
+				c <- &Envelope{RR: in.Answer}
 				return
 			}
-			c <- &Envelope{in.Answer, nil}
+			c <- &Envelope{RR: in.Answer}
 		}
 	}
 	panic("dns: not reached")
 }
 
-/*
-	// re-read 'n stuff must be pushed down
-	timeout = dnsTimeout
-	if t.ReadTimeout != 0 {
-		timeout = t.ReadTimeout
+// InIxfr performs an IXFR as described in RFC 1995, sending each remove/add
+// delta from the server on c as its own Envelope tagged with EnvelopeRemove
+// or EnvelopeAdd. If the server only has a single SOA to offer, the client
+// is already up to date and c is closed without any Envelope being sent. If
+// the server answers with a full zone instead of an incremental one, the
+// whole reply is forwarded as EnvelopeAxfrFallback envelopes, AXFR-style.
+func (t *Transfer) InIxfr(id uint16, c chan *Envelope) {
+	var serial uint32 // The serial from the server's leading SOA, the target of this IXFR.
+	first := true
+	state := EnvelopeAdd // State of the set currently being accumulated in cur; toggled on each SOA seen.
+	final := false       // True once the SOA that starts the last add-set has been seen.
+	var cur []RR
+	defer t.Close()
+	defer close(c)
+
+	flush := func() {
+		if len(cur) == 0 {
+			return
+		}
+		c <- &Envelope{RR: cur, Kind: state}
+		cur = nil
 	}
-	co.SetReadDeadline(time.Now().Add(dnsTimeout))
-	timeout = dnsTimeout
-	if t.WriteTimeout != 0 {
-		timeout = t.WriteTimeout
+
+	for {
+		in, err := t.ReadMsg()
+		if err != nil {
+			// Only a clean EOF after the final add-set has started means
+			// the transfer completed; anything else (a truncated read, a
+			// TSIG failure, a reset) must not be reported as success, or a
+			// truncated or unauthenticated tail would pass as a full IXFR.
+			if final && err == io.EOF {
+				flush()
+				return
+			}
+			c <- &Envelope{Error: err}
+			return
+		}
+		if id != in.Id {
+			c <- &Envelope{RR: in.Answer, Error: ErrId}
+			return
+		}
+
+		answer := in.Answer
+		if first {
+			first = false
+			if !isSOAFirst(in) {
+				c <- &Envelope{RR: in.Answer, Error: ErrSoa}
+				return
+			}
+			serial = in.Answer[0].(*SOA).Serial
+			t.tsigTimersOnly = true
+			// A single SOA RR means the client is already up to date.
+			if len(in.Answer) == 1 {
+				return
+			}
+			// If the RR right after the leading SOA isn't itself a SOA,
+			// the server doesn't have the history for an incremental
+			// transfer and fell back to sending the full zone instead.
+			if in.Answer[1].Header().Rrtype != TypeSOA {
+				t.inIxfrAxfrFallback(id, in, c)
+				return
+			}
+			answer = in.Answer[1:]
+		}
+
+		for _, rr := range answer {
+			soa, ok := rr.(*SOA)
+			if !ok {
+				cur = append(cur, rr)
+				continue
+			}
+			flush()
+			if state == EnvelopeAdd {
+				state = EnvelopeRemove
+				continue
+			}
+			state = EnvelopeAdd
+			if soa.Serial == serial {
+				final = true
+			}
+		}
 	}
-	co.SetWriteDeadline(time.Now().Add(dnsTimeout))
-	defer co.Close()
-	return nil
-*/
+}
 
-func (t *Transfer) Out(w ResponseWriter, q *Msg, a string) (chan *Envelope, error) {
-	ch := make(chan *Envelope)
-	r := new(Msg)
-	r.SetReply(q)
-	r.Authoritative = true
-	go func() {
-	for x := range ch {
-		// assume it fits TODO(miek): fix
-		r.Answer = append(r.Answer, x.RR...)
-		if err := w.WriteMsg(r); err != nil {
+// inIxfrAxfrFallback forwards in and every following message as
+// EnvelopeAxfrFallback envelopes, using the same AXFR framing InAxfr uses.
+func (t *Transfer) inIxfrAxfrFallback(id uint16, in *Msg, c chan *Envelope) {
+	for {
+		c <- &Envelope{RR: in.Answer, Kind: EnvelopeAxfrFallback}
+		if isSOALast(in) {
 			return
 		}
+		var err error
+		in, err = t.ReadMsg()
+		if err != nil {
+			c <- &Envelope{Error: err}
+			return
+		}
+		if id != in.Id {
+			c <- &Envelope{RR: in.Answer, Error: ErrId}
+			return
+		}
+	}
+}
+
+// Out performs an outgoing AXFR. The caller streams the zone's RRs,
+// SOA-first, as one or more Envelopes on in; Out packs them into as many
+// successive messages as needed to stay under MaxMsgSize, splitting a large
+// Envelope across messages if it doesn't fit. The zone's SOA is pulled off
+// the first Envelope and repeated as the last RR of the final message, and
+// every message after the first is signed with TsigTimersOnly(true). Write
+// failures are reported on the returned channel, which is closed once in is
+// drained or a write fails.
+func (t *Transfer) Out(w ResponseWriter, q *Msg, in chan *Envelope) (chan error, error) {
+	return t.out(w, q, in, true)
+}
+
+// OutIxfr is the server-side counterpart of InIxfr, but it does not build
+// the RFC 1995 add/remove framing for the caller: Kind is informational
+// only, and out never inspects it. Every delimiter SOA - the leading target
+// SOA and each remove-set/add-set SOA - must already be present in the RR
+// slice of the Envelope it belongs to; OutIxfr just chunks and signs the
+// RRs it's given exactly like Out, and - since the caller's own SOA framing
+// already closes the transfer - never appends a trailing SOA of its own.
+// Because InIxfr strips those delimiter SOAs out before handing Envelopes
+// to its caller, an Envelope read from InIxfr cannot be replayed through
+// OutIxfr unmodified; a caller re-serving a transfer it received via InIxfr
+// must re-embed the SOAs itself.
+func (t *Transfer) OutIxfr(w ResponseWriter, q *Msg, in chan *Envelope) (chan error, error) {
+	return t.out(w, q, in, false)
+}
+
+// out is the shared chunking/signing engine behind Out and OutIxfr.
+func (t *Transfer) out(w ResponseWriter, q *Msg, in chan *Envelope, appendTrailingSOA bool) (chan error, error) {
+	errch := make(chan error, 1)
+
+	newMsg := func() *Msg {
+		r := new(Msg)
+		r.SetReply(q)
+		r.Authoritative = true
+		return r
 	}
-//		w.TsigTimersOnly(true)
-//		rep.Answer = nil
+
+	go func() {
+		defer close(errch)
+		r := newMsg()
+		var soa RR
+
+		flush := func() error {
+			if len(r.Answer) == 0 {
+				return nil
+			}
+			if err := w.WriteMsg(r); err != nil {
+				return err
+			}
+			w.TsigTimersOnly(true) // Only the first message gets a full TSIG.
+			r = newMsg()
+			return nil
+		}
+
+		appendRR := func(rr RR) error {
+			r.Answer = append(r.Answer, rr)
+			if r.Len() > MaxMsgSize {
+				// This RR doesn't fit, flush without it and carry it
+				// over to the next message.
+				overflow := r.Answer[len(r.Answer)-1]
+				r.Answer = r.Answer[:len(r.Answer)-1]
+				if err := flush(); err != nil {
+					return err
+				}
+				r.Answer = append(r.Answer, overflow)
+			}
+			return nil
+		}
+
+		for x := range in {
+			if x.Error != nil {
+				errch <- x.Error
+				return
+			}
+			for _, rr := range x.RR {
+				if soa == nil {
+					if s, ok := rr.(*SOA); ok {
+						soa = s
+					}
+				}
+				if err := appendRR(rr); err != nil {
+					errch <- err
+					return
+				}
+			}
+		}
+		if appendTrailingSOA && soa != nil {
+			// Route the closing SOA through the same size check as every
+			// other RR, so it can't push the final message over MaxMsgSize.
+			if err := appendRR(soa); err != nil {
+				errch <- err
+				return
+			}
+		}
+		if err := flush(); err != nil {
+			errch <- err
+		}
 	}()
-	return ch, nil
+
+	return errch, nil
 }
 
-// ReadMsg reads a message from the transfer connection t.
+// ReadMsg reads a message from the transfer connection t. Messages on the
+// wire are length-prefixed (RFC 1035 section 4.2.2); the buffer backing the
+// message is borrowed from a pool of power-of-two buckets instead of
+// allocating MaxMsgSize bytes for every message, which matters once a zone
+// runs to thousands of envelopes. The pooled buffer is returned before
+// ReadMsg returns, relying on Msg.Unpack having fully decoded every RR out
+// of it (no RR type retains a sub-slice of the wire bytes it was unpacked
+// from); the returned *Msg is a scratch value owned by t and is only valid
+// until the next call to ReadMsg, but the RRs it contains, once copied out
+// (as InAxfr, InIxfr and NextRR all do), remain valid indefinitely even
+// after the buffer they were unpacked from has been reused.
 func (t *Transfer) ReadMsg() (*Msg, error) {
-	m := new(Msg)
-	p := make([]byte, MaxMsgSize)
-	n, err := t.Read(p)
-	if err != nil && n == 0 {
+	timeout := dnsTimeout
+	if t.ReadTimeout != 0 {
+		timeout = t.ReadTimeout
+	}
+	t.SetReadDeadline(time.Now().Add(timeout))
+
+	var lenbuf [2]byte
+	if _, err := io.ReadFull(t, lenbuf[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(lenbuf[:]))
+
+	p := getBuf(n)
+	defer putBuf(p)
+	if _, err := io.ReadFull(t, p); err != nil {
 		return nil, err
 	}
-	p = p[:n]
+
+	if t.msg == nil {
+		t.msg = new(Msg)
+	}
+	m := t.msg
+	*m = Msg{}
 	if err := m.Unpack(p); err != nil {
 		return nil, err
 	}
@@ -151,13 +476,22 @@ func (t *Transfer) ReadMsg() (*Msg, error) {
 			return m, ErrSecret
 		}
 		// Need to work on the original message p, as that was used to calculate the tsig.
-		err = TsigVerify(p, t.TsigSecret[ts.Hdr.Name], t.tsigRequestMAC, t.tsigTimersOnly)
+		if err := TsigVerify(p, t.TsigSecret[ts.Hdr.Name], t.tsigRequestMAC, t.tsigTimersOnly); err != nil {
+			return m, err
+		}
 	}
-	return m, err
+	return m, nil
 }
 
-// WriteMsg write a message throught the transfer connection t.
+// WriteMsg write a message throught the transfer connection t. Like ReadMsg,
+// it length-prefixes the message on the wire per RFC 1035 section 4.2.2.
 func (t *Transfer) WriteMsg(m *Msg) (err error) {
+	timeout := dnsTimeout
+	if t.WriteTimeout != 0 {
+		timeout = t.WriteTimeout
+	}
+	t.SetWriteDeadline(time.Now().Add(timeout))
+
 	var out []byte
 	if ts := m.IsTsig(); t != nil {
 		if _, ok := t.TsigSecret[ts.Hdr.Name]; !ok {
@@ -170,62 +504,60 @@ func (t *Transfer) WriteMsg(m *Msg) (err error) {
 	if err != nil {
 		return err
 	}
+	var lenbuf [2]byte
+	binary.BigEndian.PutUint16(lenbuf[:], uint16(len(out)))
+	if _, err = t.Write(lenbuf[:]); err != nil {
+		return err
+	}
 	if _, err = t.Write(out); err != nil {
 		return err
 	}
 	return nil
 }
 
-/*
+// bufPools holds power-of-two-sized byte slice pools, indexed by log2 of the
+// bucket size (bufPools[i] holds buffers of size 1<<i), up to MaxMsgSize.
+var bufPools [17]sync.Pool
 
-func (w *reply) ixfrIn(q *Msg, c chan *Envelope) {
-	var serial uint32 // The first serial seen is the current server serial
-	first := true
-	defer w.conn.Close()
-	defer close(c)
-	for {
-		in, err := w.receive()
-		if err != nil {
-			c <- &Envelope{in.Answer, err}
-			return
-		}
-		if q.Id != in.Id {
-			c <- &Envelope{in.Answer, ErrId}
-			return
+func init() {
+	for i := range bufPools {
+		size := 1 << uint(i)
+		bufPools[i].New = func() interface{} {
+			b := make([]byte, size)
+			return &b
 		}
-		if first {
-			// A single SOA RR signals "no changes"
-			if len(in.Answer) == 1 && checkSOA(in, true) {
-				c <- &Envelope{in.Answer, nil}
-				return
-			}
+	}
+}
 
-			// Check if the returned answer is ok
-			if !checkSOA(in, true) {
-				c <- &Envelope{in.Answer, ErrSoa}
-				return
-			}
-			// This serial is important
-			serial = in.Answer[0].(*SOA).Serial
-			first = !first
-		}
+// bufBucket returns the index into bufPools holding buffers big enough for n bytes.
+func bufBucket(n int) int {
+	i := 0
+	for 1<<uint(i) < n {
+		i++
+	}
+	return i
+}
 
-		// Now we need to check each message for SOA records, to see what we need to do
-		if !first {
-			w.tsigTimersOnly = true
-			// If the last record in the IXFR contains the servers' SOA,  we should quit
-			if v, ok := in.Answer[len(in.Answer)-1].(*SOA); ok {
-				if v.Serial == serial {
-					c <- &Envelope{in.Answer, nil}
-					return
-				}
-			}
-			c <- &Envelope{in.Answer, nil}
-		}
+// getBuf returns a []byte of length n, reused from bufPools when n fits.
+func getBuf(n int) []byte {
+	i := bufBucket(n)
+	if i >= len(bufPools) {
+		return make([]byte, n)
 	}
-	panic("dns: not reached")
+	b := bufPools[i].Get().(*[]byte)
+	return (*b)[:n]
+}
+
+// putBuf returns a buffer obtained from getBuf to its pool.
+func putBuf(b []byte) {
+	c := cap(b)
+	i := bufBucket(c)
+	if i >= len(bufPools) || 1<<uint(i) != c {
+		return
+	}
+	b = b[:c]
+	bufPools[i].Put(&b)
 }
-*/
 
 func isSOAFirst(in *Msg) bool {
 	if len(in.Answer) > 0 {
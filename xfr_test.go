@@ -0,0 +1,561 @@
+// Copyright 2011 Miek Gieben. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeResponseWriter is a minimal ResponseWriter that records every message
+// written to it instead of putting anything on the wire.
+type fakeResponseWriter struct {
+	written []*Msg
+}
+
+func (f *fakeResponseWriter) LocalAddr() net.Addr  { return nil }
+func (f *fakeResponseWriter) RemoteAddr() net.Addr { return nil }
+func (f *fakeResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+func (f *fakeResponseWriter) Close() error      { return nil }
+func (f *fakeResponseWriter) TsigStatus() error { return nil }
+func (f *fakeResponseWriter) TsigTimersOnly(bool) {}
+func (f *fakeResponseWriter) Hijack()             {}
+func (f *fakeResponseWriter) WriteMsg(m *Msg) error {
+	f.written = append(f.written, m)
+	return nil
+}
+
+func soaRR(id uint16, serial uint32) *SOA {
+	return &SOA{
+		Hdr:     RR_Header{Name: "example.org.", Rrtype: TypeSOA, Class: ClassINET, Ttl: 3600},
+		Ns:      "a.example.org.",
+		Mbox:    "hostmaster.example.org.",
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   3600,
+		Expire:  3600,
+		Minttl:  3600,
+	}
+}
+
+func aRR(name string, ip net.IP) *A {
+	return &A{Hdr: RR_Header{Name: name, Rrtype: TypeA, Class: ClassINET, Ttl: 3600}, A: ip}
+}
+
+func writeIxfrMsg(t *testing.T, conn net.Conn, id uint16, answer []RR) {
+	t.Helper()
+	m := new(Msg)
+	m.Id = id
+	m.Question = []Question{{Name: "example.org.", Qtype: TypeIXFR, Qclass: ClassINET}}
+	m.Answer = answer
+	srv := &Transfer{Conn: Conn{Conn: conn}}
+	if err := srv.WriteMsg(m); err != nil {
+		t.Fatalf("writing fake IXFR message: %v", err)
+	}
+}
+
+// newLocalTLSListener starts a TLS listener on 127.0.0.1 backed by a
+// freshly generated self-signed certificate, for tests that need a real
+// "tcp-tls" peer rather than a net.Pipe. It returns the listener and a
+// client-side tls.Config that trusts that certificate.
+func newLocalTLSListener(t *testing.T) (net.Listener, *tls.Config) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("creating test certificate: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	return ln, &tls.Config{InsecureSkipVerify: true}
+}
+
+// TestInIxfrClassifiesDeltas checks that InIxfr correctly splits the
+// RFC 1995 SOA-delimited sequence into alternating EnvelopeRemove/
+// EnvelopeAdd envelopes.
+func TestInIxfrClassifiesDeltas(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	const id = 55
+	removed1 := aRR("old1.example.org.", net.IPv4(192, 0, 2, 1))
+	added1 := aRR("new1.example.org.", net.IPv4(192, 0, 2, 2))
+	removed2 := aRR("old2.example.org.", net.IPv4(192, 0, 2, 3))
+	added2 := aRR("new2.example.org.", net.IPv4(192, 0, 2, 4))
+
+	go func() {
+		defer server.Close()
+		writeIxfrMsg(t, server, id, []RR{
+			soaRR(id, 3), // the server's current serial, announced up front
+			soaRR(id, 1), removed1, // remove-set for 1 -> 2
+			soaRR(id, 2), added1, // add-set for 1 -> 2
+			soaRR(id, 2), removed2, // remove-set for 2 -> 3
+			soaRR(id, 3), added2, // add-set for 2 -> 3 (matches the target serial)
+		})
+		// The connection closing cleanly after the final add-set is what
+		// signals the end of the transfer.
+	}()
+
+	xfr := &Transfer{Conn: Conn{Conn: client}}
+	env := make(chan *Envelope)
+	go xfr.InIxfr(id, env)
+
+	var got []*Envelope
+	for e := range env {
+		got = append(got, e)
+	}
+
+	want := []struct {
+		kind Kind
+		rr   RR
+	}{
+		{EnvelopeRemove, removed1},
+		{EnvelopeAdd, added1},
+		{EnvelopeRemove, removed2},
+		{EnvelopeAdd, added2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d envelopes, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		e := got[i]
+		if e.Error != nil {
+			t.Fatalf("envelope %d: unexpected error: %v", i, e.Error)
+		}
+		if e.Kind != w.kind {
+			t.Errorf("envelope %d: got Kind %v, want %v", i, e.Kind, w.kind)
+		}
+		if len(e.RR) != 1 || e.RR[0].Header().Name != w.rr.Header().Name {
+			t.Errorf("envelope %d: got RR %+v, want %+v", i, e.RR, w.rr)
+		}
+	}
+}
+
+// TestInIxfrReportsNonEOFErrorAfterFinalAddSet guards against silently
+// treating a corrupted/truncated tail as a successful transfer once the
+// final add-set has started: only a clean io.EOF may end the transfer at
+// that point, any other read error must still surface as an Envelope.Error.
+func TestInIxfrReportsNonEOFErrorAfterFinalAddSet(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	const id = 77
+	added := aRR("new.example.org.", net.IPv4(192, 0, 2, 9))
+
+	go func() {
+		defer server.Close()
+		writeIxfrMsg(t, server, id, []RR{
+			soaRR(id, 2), // current serial
+			soaRR(id, 1), aRR("old.example.org.", net.IPv4(192, 0, 2, 8)),
+			soaRR(id, 2), added, // add-set start matches the target serial: "final" becomes true
+		})
+		// Instead of closing cleanly, write a bogus length-prefixed message
+		// that fails to unpack, simulating a truncated/corrupted tail.
+		server.Write([]byte{0x00, 0x03, 0xff, 0xff, 0xff})
+	}()
+
+	xfr := &Transfer{Conn: Conn{Conn: client}}
+	env := make(chan *Envelope)
+	go xfr.InIxfr(id, env)
+
+	var last *Envelope
+	for e := range env {
+		last = e
+	}
+	if last == nil || last.Error == nil {
+		t.Fatalf("got %+v, want a final Envelope carrying the read error, not a silent close", last)
+	}
+}
+
+// TestInIxfrAxfrFallback checks that InIxfr recognizes a server falling back
+// to a full zone transfer (a non-SOA RR immediately after the leading SOA)
+// and forwards the whole message as a single EnvelopeAxfrFallback envelope,
+// AXFR-style, instead of trying to interpret it as IXFR deltas.
+func TestInIxfrAxfrFallback(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	const id = 66
+	soa := soaRR(id, 9)
+	a1 := aRR("a1.example.org.", net.IPv4(192, 0, 2, 21))
+	a2 := aRR("a2.example.org.", net.IPv4(192, 0, 2, 22))
+
+	go func() {
+		defer server.Close()
+		// The leading SOA is immediately followed by non-SOA zone data: the
+		// server doesn't have the history for an incremental transfer and
+		// sent the full zone instead, SOA-first/SOA-last like an AXFR.
+		writeIxfrMsg(t, server, id, []RR{soa, a1, a2, soa})
+	}()
+
+	xfr := &Transfer{Conn: Conn{Conn: client}}
+	env := make(chan *Envelope)
+	go xfr.InIxfr(id, env)
+
+	var got []*Envelope
+	for e := range env {
+		got = append(got, e)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d envelopes, want 1: %+v", len(got), got)
+	}
+	e := got[0]
+	if e.Error != nil {
+		t.Fatalf("unexpected error: %v", e.Error)
+	}
+	if e.Kind != EnvelopeAxfrFallback {
+		t.Errorf("got Kind %v, want EnvelopeAxfrFallback", e.Kind)
+	}
+	if len(e.RR) != 4 {
+		t.Errorf("got %d RRs, want 4 (the whole fallback message): %+v", len(e.RR), e.RR)
+	}
+}
+
+// TestOutChunksLargeTransfer checks that out() splits the answer across
+// multiple messages once MaxMsgSize would otherwise be exceeded, that no
+// message (the last one included) is larger than MaxMsgSize, and that a
+// plain AXFR (Out, not OutIxfr) ends with exactly one trailing SOA.
+func TestOutChunksLargeTransfer(t *testing.T) {
+	q := new(Msg)
+	q.SetQuestion("example.org.", TypeAXFR)
+
+	soa := soaRR(q.Id, 1)
+
+	// A TXT payload large enough that only a handful fit under MaxMsgSize,
+	// so the transfer is forced to split across several messages.
+	big := make([]byte, 4096)
+	for i := range big {
+		big[i] = 'a'
+	}
+
+	var rrs []RR
+	for i := 0; i < 20; i++ {
+		rrs = append(rrs, &TXT{
+			Hdr: RR_Header{Name: "example.org.", Rrtype: TypeTXT, Class: ClassINET, Ttl: 3600},
+			Txt: []string{string(big)},
+		})
+	}
+
+	w := &fakeResponseWriter{}
+	xfr := new(Transfer)
+	in := make(chan *Envelope)
+	errch, err := xfr.Out(w, q, in)
+	if err != nil {
+		t.Fatalf("Out: %v", err)
+	}
+
+	go func() {
+		// Only the leading SOA is supplied; out must append the trailing
+		// copy itself for this to be a valid AXFR.
+		in <- &Envelope{RR: append([]RR{soa}, rrs...)}
+		close(in)
+	}()
+
+	if err := <-errch; err != nil {
+		t.Fatalf("out: %v", err)
+	}
+
+	if len(w.written) < 2 {
+		t.Fatalf("got %d messages, want the transfer split across more than one", len(w.written))
+	}
+	for i, m := range w.written {
+		if m.Len() > MaxMsgSize {
+			t.Errorf("message %d: got %d bytes, want <= MaxMsgSize (%d)", i, m.Len(), MaxMsgSize)
+		}
+	}
+	last := w.written[len(w.written)-1]
+	if len(last.Answer) == 0 || last.Answer[len(last.Answer)-1] != soa {
+		t.Errorf("got last message without the trailing SOA as its final RR: %+v", last.Answer)
+	}
+	// The envelope only supplied the leading SOA, so if the auto-append
+	// logic regressed and stopped appending the trailing copy, the last
+	// message would have to end in one of the TXT RRs instead; if it
+	// instead regressed the other way and appended a second copy on top
+	// of one already there, the last two RRs would both be the SOA.
+	if len(last.Answer) > 1 && last.Answer[len(last.Answer)-2] == soa {
+		t.Errorf("got a duplicate trailing SOA in the last message: %+v", last.Answer)
+	}
+}
+
+// TestOutIxfrPassesRRsThroughVerbatim checks that OutIxfr never appends a
+// trailing SOA of its own and never looks at Kind: the caller's own SOA
+// framing, embedded in the Envelopes it sends, passes through unchanged and
+// the whole sequence still gets chunked/signed the same way Out does.
+func TestOutIxfrPassesRRsThroughVerbatim(t *testing.T) {
+	q := new(Msg)
+	q.SetQuestion("example.org.", TypeIXFR)
+
+	target := soaRR(q.Id, 3)
+	oldSOA := soaRR(q.Id, 1)
+	removed := aRR("old1.example.org.", net.IPv4(192, 0, 2, 31))
+	midSOA := soaRR(q.Id, 2)
+	added := aRR("new1.example.org.", net.IPv4(192, 0, 2, 32))
+	finalSOA := soaRR(q.Id, 3)
+
+	w := &fakeResponseWriter{}
+	xfr := new(Transfer)
+	in := make(chan *Envelope)
+	errch, err := xfr.OutIxfr(w, q, in)
+	if err != nil {
+		t.Fatalf("OutIxfr: %v", err)
+	}
+
+	go func() {
+		in <- &Envelope{RR: []RR{target, oldSOA, removed}, Kind: EnvelopeRemove}
+		in <- &Envelope{RR: []RR{midSOA, added, finalSOA}, Kind: EnvelopeAdd}
+		close(in)
+	}()
+
+	if err := <-errch; err != nil {
+		t.Fatalf("out: %v", err)
+	}
+
+	var got []RR
+	for _, m := range w.written {
+		got = append(got, m.Answer...)
+	}
+	want := []RR{target, oldSOA, removed, midSOA, added, finalSOA}
+	if len(got) != len(want) {
+		t.Fatalf("got %d RRs, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("RR %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// TestReadMsgBufferReuse verifies the invariant ReadMsg's pooling relies on:
+// once an RR has been unpacked, it no longer references the wire buffer it
+// came from, so that buffer can go straight back into the pool and be
+// overwritten by the very next ReadMsg call without corrupting it.
+func TestReadMsgBufferReuse(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	const id = 99
+	first := "first-message-payload"
+	second := "second-message-payload-overwrites-the-pool-bucket"
+
+	go func() {
+		defer server.Close()
+		srv := &Transfer{Conn: Conn{Conn: server}}
+		for _, txt := range []string{first, second} {
+			m := new(Msg)
+			m.Id = id
+			m.Question = []Question{{Name: "example.org.", Qtype: TypeAXFR, Qclass: ClassINET}}
+			m.Answer = []RR{&TXT{
+				Hdr: RR_Header{Name: "example.org.", Rrtype: TypeTXT, Class: ClassINET, Ttl: 3600},
+				Txt: []string{txt},
+			}}
+			if err := srv.WriteMsg(m); err != nil {
+				t.Errorf("writing fake message: %v", err)
+				return
+			}
+		}
+	}()
+
+	xfr := &Transfer{Conn: Conn{Conn: client}}
+
+	in1, err := xfr.ReadMsg()
+	if err != nil {
+		t.Fatalf("first ReadMsg: %v", err)
+	}
+	// Copy out the slice header (but not the underlying TXT string data)
+	// before the second ReadMsg reuses t.msg and the pooled wire buffer.
+	answer1 := in1.Answer
+
+	if _, err := xfr.ReadMsg(); err != nil {
+		t.Fatalf("second ReadMsg: %v", err)
+	}
+
+	got := answer1[0].(*TXT).Txt[0]
+	if got != first {
+		t.Errorf("first message's RR changed after pool buffer reuse: got %q, want %q", got, first)
+	}
+}
+
+// TestInOverTLS checks that In actually dials with TLS and that TLSConfig is
+// honored, by running a full AXFR against a real "tcp-tls" listener instead
+// of a net.Pipe.
+func TestInOverTLS(t *testing.T) {
+	ln, clientCfg := newLocalTLSListener(t)
+	defer ln.Close()
+
+	const id = 44
+	soa := soaRR(id, 7)
+	added := aRR("new.example.org.", net.IPv4(192, 0, 2, 41))
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		srv := &Transfer{Conn: Conn{Conn: conn}}
+		if _, err := srv.ReadMsg(); err != nil { // the client's AXFR query
+			t.Errorf("reading AXFR query: %v", err)
+			return
+		}
+		writeIxfrMsg(t, conn, id, []RR{soa, added, soa})
+	}()
+
+	q := new(Msg)
+	q.SetQuestion("example.org.", TypeAXFR)
+	q.Id = id
+
+	xfr := &Transfer{Net: "tcp-tls", TLSConfig: clientCfg}
+	env := make(chan *Envelope)
+	if err := xfr.In(q, ln.Addr().String(), env); err != nil {
+		t.Fatalf("In: %v", err)
+	}
+
+	var got []*Envelope
+	for e := range env {
+		got = append(got, e)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d envelopes, want 1: %+v", len(got), got)
+	}
+	if got[0].Error != nil {
+		t.Fatalf("unexpected error: %v", got[0].Error)
+	}
+	if len(got[0].RR) != 3 || got[0].RR[1].Header().Name != added.Header().Name {
+		t.Errorf("got RR %+v, want the added RR as the middle element", got[0].RR)
+	}
+}
+
+// TestReadMsgReadTimeout checks that ReadMsg returns a deadline error within
+// bounded time when talking to a peer that never writes anything, instead of
+// hanging the goroutine forever.
+func TestReadMsgReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	xfr := &Transfer{Conn: Conn{Conn: client}, ReadTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	_, err := xfr.ReadMsg()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("ReadMsg took %v to return, want well under 5s", elapsed)
+	}
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		t.Fatalf("got error %v, want a net.Error with Timeout() true", err)
+	}
+}
+
+// TestWriteMsgWriteTimeout checks that WriteMsg returns a deadline error
+// within bounded time when talking to a peer that never reads anything,
+// instead of hanging the goroutine forever.
+func TestWriteMsgWriteTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	xfr := &Transfer{Conn: Conn{Conn: client}, WriteTimeout: 50 * time.Millisecond}
+
+	m := new(Msg)
+	m.SetQuestion("example.org.", TypeAXFR)
+
+	start := time.Now()
+	err := xfr.WriteMsg(m)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("WriteMsg took %v to return, want well under 5s", elapsed)
+	}
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		t.Fatalf("got error %v, want a net.Error with Timeout() true", err)
+	}
+}
+
+// TestInNextRR drives a multi-message AXFR through In (with a nil envelope
+// channel) and NextRR, checking that RRs come back in order across the
+// message boundary and that NextRR reports io.EOF once the transfer ends.
+func TestInNextRR(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	const id = 31
+	soa := soaRR(id, 5)
+	a1 := aRR("a1.example.org.", net.IPv4(192, 0, 2, 11))
+	a2 := aRR("a2.example.org.", net.IPv4(192, 0, 2, 12))
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		srv := &Transfer{Conn: Conn{Conn: conn}}
+		if _, err := srv.ReadMsg(); err != nil { // the client's AXFR query
+			t.Errorf("reading AXFR query: %v", err)
+			return
+		}
+		// Split the zone across two messages so NextRR has to cross a
+		// message boundary mid-stream.
+		writeIxfrMsg(t, conn, id, []RR{soa, a1})
+		writeIxfrMsg(t, conn, id, []RR{a2, soa})
+	}()
+
+	q := new(Msg)
+	q.SetQuestion("example.org.", TypeAXFR)
+	q.Id = id
+
+	xfr := new(Transfer)
+	if err := xfr.In(q, ln.Addr().String(), nil); err != nil {
+		t.Fatalf("In: %v", err)
+	}
+
+	var got []RR
+	for {
+		rr, err := xfr.NextRR()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextRR: %v", err)
+		}
+		got = append(got, rr)
+	}
+
+	want := []RR{soa, a1, a2, soa}
+	if len(got) != len(want) {
+		t.Fatalf("got %d RRs, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Header().Name != want[i].Header().Name || got[i].Header().Rrtype != want[i].Header().Rrtype {
+			t.Errorf("RR %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}